@@ -7,14 +7,23 @@ import (
 	"unsafe"
 
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 
-	"github.com/Sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
 	"golang.org/x/sys/windows/svc/eventlog"
@@ -39,23 +48,120 @@ const (
 	eventFatal = 4
 
 	eventExtraOffset = 10 // Add this to any event to get a string that supports extended data
+
+	// eventCategoryStructured marks an event whose second insertion string
+	// is a JSON object rather than free text; it must match the category
+	// table in event_messages.mc so Event Viewer renders typed fields.
+	eventCategoryStructured = 1
+
+	// EventLogFormatText and EventLogFormatJSON select how etwHook.Fire
+	// renders logrus.Fields into the event's second insertion string.
+	EventLogFormatText = "text"
+	EventLogFormatJSON = "json"
+
+	// hnsServiceName and vmComputeServiceName are the Windows services that
+	// host networking (and therefore per-host-subnet route programming)
+	// depends on. They're the roots we walk when logging service
+	// dependency diagnostics on startup failures.
+	hnsServiceName       = "hns"
+	vmComputeServiceName = "vmcompute"
+
+	// maxServiceDependencyDepth bounds how deep logServiceDependencyGraph
+	// recurses, so a pathological dependency chain can't make a bug report
+	// hang or balloon.
+	maxServiceDependencyDepth = 8
+
+	// WTSSessionLogon and WTSSessionLogoff are the event types WTS session
+	// change notifications carry, passed through to OnSessionChange.
+	WTSSessionLogon  = 0x5
+	WTSSessionLogoff = 0x6
+
+	// pbtAPMResumeSuspend and pbtAPMResumeAutomatic are the Win32
+	// PBT_APMRESUMESUSPEND / PBT_APMRESUMEAUTOMATIC power-event codes.
+	// golang.org/x/sys/windows doesn't define these, so they're declared
+	// locally instead.
+	pbtAPMResumeSuspend   = 0x7
+	pbtAPMResumeAutomatic = 0x12
 )
 
 var (
-	service       *handler
-	setStdHandle  = windows.NewLazySystemDLL("kernel32.dll").NewProc("SetStdHandle")
-	oldStderr     syscall.Handle
-	panicFile     *os.File
-	serviceSignal = make(chan bool)
+	service          *handler
+	setStdHandle     = windows.NewLazySystemDLL("kernel32.dll").NewProc("SetStdHandle")
+	oldStderr        syscall.Handle
+	// panicFileMu guards panicFile: it's reassigned by rotatePanicFile from
+	// the background monitorPanicFileSize goroutine and read/closed by
+	// removePanicFile from the service stop path.
+	panicFileMu      sync.Mutex
+	panicFile        *os.File
+	panicMonitorStop chan struct{}
+	panicMonitorDone chan struct{}
+	serviceSignal    = make(chan bool)
 )
 
 type handler struct {
 	tosvc   chan bool
 	fromsvc chan error
+	cfg     *InstallConfig
+
+	// OnSessionChange, OnResumeFromSuspend and OnNetBindAdd are optional
+	// callbacks the route-update subsystem registers so it can re-probe
+	// HNS networks after a laptop wakes from suspend or a NIC is rebound,
+	// instead of letting routes silently go stale.
+	OnSessionChange     func(eventType uint32, sessionID uint32)
+	OnResumeFromSuspend func()
+	OnNetBindAdd        func()
+}
+
+// wtsSessionNotification mirrors the WTSSESSION_NOTIFICATION struct pointed
+// to by a SERVICE_CONTROL_SESSIONCHANGE ChangeRequest's EventData.
+type wtsSessionNotification struct {
+	Size      uint32
+	SessionID uint32
+}
+
+// sessionIDFromEventData reads the SessionID out of the
+// WTSSESSION_NOTIFICATION that eventData points to. eventData is only ever
+// the live ChangeRequest.EventData handed to Execute for a
+// SERVICE_CONTROL_SESSIONCHANGE, read synchronously within that call, so the
+// uintptr->unsafe.Pointer conversion is safe even though go vet's unsafeptr
+// check can't prove it from here.
+func sessionIDFromEventData(eventData uintptr) uint32 {
+	if eventData == 0 {
+		return 0
+	}
+	n := (*wtsSessionNotification)(unsafe.Pointer(eventData)) //nolint:govet // see doc comment: eventData is a live SCM pointer for the duration of this call
+	return n.SessionID
+}
+
+// correlationIDKey is the context.Context key that carries the per-lifecycle
+// correlation ID generated in Init. Logging through logrus.WithContext
+// propagates it all the way to etwHook.Fire, so every event log entry logged
+// with that context carries the same ID.
+type correlationIDKey struct{}
+
+func newCorrelationContext() context.Context {
+	return context.WithValue(context.Background(), correlationIDKey{}, generateCorrelationID())
+}
+
+func correlationIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+func generateCorrelationID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("unavailable-%d", os.Getpid())
+	}
+	return hex.EncodeToString(b[:])
 }
 
 type etwHook struct {
-	log *eventlog.Log
+	log    *eventlog.Log
+	format string
 }
 
 func (h *etwHook) Levels() []logrus.Level {
@@ -98,18 +204,44 @@ func (h *etwHook) Fire(e *logrus.Entry) error {
 		return errors.New("unknown level")
 	}
 
+	// raw_data is pulled out of the fields so callers (e.g. the subnet
+	// router attaching a packet trace) can ship a binary blob via the
+	// ReportEvent raw-data parameters instead of cramming it into the
+	// insertion strings.
+	var rawData []byte
+	fields := make(logrus.Fields, len(e.Data))
+	for k, v := range e.Data {
+		if k == "raw_data" {
+			if b, ok := v.([]byte); ok {
+				rawData = b
+			}
+			continue
+		}
+		fields[k] = v
+	}
+	if id := correlationIDFromContext(e.Context); id != "" {
+		fields["correlation_id"] = id
+	}
+
 	// If there is additional data, include it as a second string.
 	exts := ""
-	if len(e.Data) > 0 {
-		fs := bytes.Buffer{}
-		for k, v := range e.Data {
-			fs.WriteString(k)
-			fs.WriteByte('=')
-			fmt.Fprint(&fs, v)
-			fs.WriteByte(' ')
+	if len(fields) > 0 {
+		if h.format == EventLogFormatJSON {
+			b, err := json.Marshal(fields)
+			if err != nil {
+				return err
+			}
+			exts = string(b)
+		} else {
+			fs := bytes.Buffer{}
+			for k, v := range fields {
+				fs.WriteString(k)
+				fs.WriteByte('=')
+				fmt.Fprint(&fs, v)
+				fs.WriteByte(' ')
+			}
+			exts = fs.String()[:fs.Len()-1]
 		}
-
-		exts = fs.String()[:fs.Len()-1]
 		eid += eventExtraOffset
 	}
 
@@ -138,7 +270,283 @@ func (h *etwHook) Fire(e *logrus.Entry) error {
 		count++
 	}
 
-	return windows.ReportEvent(h.log.Handle, etype, 0, eid, 0, count, 0, &ss[0], nil)
+	var rawPtr *byte
+	if len(rawData) > 0 {
+		rawPtr = &rawData[0]
+	}
+
+	var category uint16
+	if h.format == EventLogFormatJSON && exts != "" {
+		category = eventCategoryStructured
+	}
+
+	return windows.ReportEvent(h.log.Handle, etype, category, eid, 0, count, uint32(len(rawData)), &ss[0], rawPtr)
+}
+
+// InstallConfig customizes how the per-host-subnet Windows service is
+// installed and how its runtime process locates its working files. It lets
+// operators run multiple instances side-by-side (distinct ServiceName),
+// customize the display name/description/arguments, and tune the
+// failure-restart backoff instead of the historical hardcoded values. Zero
+// values fall back to those historical defaults, so existing callers that
+// build an InstallConfig field-by-field keep working unmodified.
+type InstallConfig struct {
+	ServiceName string
+	DisplayName string
+	Description string
+	// Args are appended to the service binary's command line, mirroring
+	// dockerd's --service-name style of passing extra flags through to a
+	// registered service.
+	Args []string
+
+	// FailureRestartDelay is used for the first two SCM failure actions;
+	// the third is always "take no action" so the service doesn't restart
+	// forever on a persistent failure.
+	FailureRestartDelay time.Duration
+	FailureResetPeriod  time.Duration
+
+	LogFile          string
+	RancherPanicFile string
+	HomeDir          string
+
+	// EventLogFormat selects how logrus fields are rendered into the event
+	// log: EventLogFormatText (the historical space-separated key=value
+	// string) or EventLogFormatJSON.
+	EventLogFormat string
+
+	// MaxLogSizeBytes and MaxLogAge bound how large/old logFile is allowed
+	// to grow before it's rotated; MaxLogBackups caps how many gzip-
+	// compressed generations are kept alongside it.
+	MaxLogSizeBytes int64
+	MaxLogAge       time.Duration
+	MaxLogBackups   int
+
+	// MaxPanicFileSizeBytes and MaxPanicBackups bound the ring of
+	// panic.log.1..N generations kept for RancherPanicFile.
+	MaxPanicFileSizeBytes int64
+	MaxPanicBackups       int
+}
+
+// DefaultInstallConfig returns the InstallConfig matching per-host-subnet's
+// historical single-instance defaults.
+func DefaultInstallConfig() *InstallConfig {
+	cfg := &InstallConfig{}
+	cfg.setDefaults()
+	return cfg
+}
+
+func (c *InstallConfig) setDefaults() {
+	if c.ServiceName == "" {
+		c.ServiceName = ServiceName
+	}
+	if c.DisplayName == "" {
+		c.DisplayName = "Rancher Per-host-subnet"
+	}
+	if c.Description == "" {
+		c.Description = "Manages per-host-subnet routes for Rancher container networking."
+	}
+	if len(c.Args) == 0 {
+		c.Args = []string{"--enable-route-update"}
+	}
+	if c.FailureRestartDelay == 0 {
+		c.FailureRestartDelay = 60 * time.Second
+	}
+	if c.FailureResetPeriod == 0 {
+		c.FailureResetPeriod = 24 * time.Hour
+	}
+	if c.LogFile == "" {
+		c.LogFile = logFile
+	}
+	if c.RancherPanicFile == "" {
+		c.RancherPanicFile = rancherPanicFile
+	}
+	if c.HomeDir == "" {
+		c.HomeDir = homeDir
+	}
+	if c.EventLogFormat == "" {
+		c.EventLogFormat = EventLogFormatText
+	}
+	if c.MaxLogSizeBytes == 0 {
+		c.MaxLogSizeBytes = 10 * 1024 * 1024 // 10MB
+	}
+	if c.MaxLogAge == 0 {
+		c.MaxLogAge = 7 * 24 * time.Hour
+	}
+	if c.MaxLogBackups == 0 {
+		c.MaxLogBackups = 5
+	}
+	if c.MaxPanicFileSizeBytes == 0 {
+		c.MaxPanicFileSizeBytes = 5 * 1024 * 1024 // 5MB
+	}
+	if c.MaxPanicBackups == 0 {
+		c.MaxPanicBackups = 5
+	}
+}
+
+// persistInstallConfig writes any non-default fields of cfg under
+// HKLM\SYSTEM\CurrentControlSet\Services\<name>\Parameters, so a service
+// that was installed with custom settings keeps them across restarts without
+// the caller having to re-specify them on the command line.
+func persistInstallConfig(cfg *InstallConfig) error {
+	defaults := DefaultInstallConfig()
+
+	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE,
+		`SYSTEM\CurrentControlSet\Services\`+cfg.ServiceName+`\Parameters`,
+		registry.SET_VALUE)
+	if err != nil {
+		return errors.Wrap(err, "opening service parameters registry key")
+	}
+	defer key.Close()
+
+	if cfg.DisplayName != defaults.DisplayName {
+		if err := key.SetStringValue("DisplayName", cfg.DisplayName); err != nil {
+			return err
+		}
+	}
+	if cfg.Description != defaults.Description {
+		if err := key.SetStringValue("Description", cfg.Description); err != nil {
+			return err
+		}
+	}
+	if !stringSlicesEqual(cfg.Args, defaults.Args) {
+		if err := key.SetStringsValue("Args", cfg.Args); err != nil {
+			return err
+		}
+	}
+	if cfg.FailureRestartDelay != defaults.FailureRestartDelay {
+		if err := key.SetDWordValue("FailureRestartDelayMs", uint32(cfg.FailureRestartDelay/time.Millisecond)); err != nil {
+			return err
+		}
+	}
+	if cfg.FailureResetPeriod != defaults.FailureResetPeriod {
+		if err := key.SetDWordValue("FailureResetPeriodSec", uint32(cfg.FailureResetPeriod/time.Second)); err != nil {
+			return err
+		}
+	}
+	if cfg.LogFile != defaults.LogFile {
+		if err := key.SetStringValue("LogFile", cfg.LogFile); err != nil {
+			return err
+		}
+	}
+	if cfg.RancherPanicFile != defaults.RancherPanicFile {
+		if err := key.SetStringValue("PanicFile", cfg.RancherPanicFile); err != nil {
+			return err
+		}
+	}
+	if cfg.HomeDir != defaults.HomeDir {
+		if err := key.SetStringValue("HomeDir", cfg.HomeDir); err != nil {
+			return err
+		}
+	}
+	if cfg.EventLogFormat != defaults.EventLogFormat {
+		if err := key.SetStringValue("EventLogFormat", cfg.EventLogFormat); err != nil {
+			return err
+		}
+	}
+	if cfg.MaxLogSizeBytes != defaults.MaxLogSizeBytes {
+		if err := key.SetQWordValue("MaxLogSizeBytes", uint64(cfg.MaxLogSizeBytes)); err != nil {
+			return err
+		}
+	}
+	if cfg.MaxLogAge != defaults.MaxLogAge {
+		if err := key.SetDWordValue("MaxLogAgeSec", uint32(cfg.MaxLogAge/time.Second)); err != nil {
+			return err
+		}
+	}
+	if cfg.MaxLogBackups != defaults.MaxLogBackups {
+		if err := key.SetDWordValue("MaxLogBackups", uint32(cfg.MaxLogBackups)); err != nil {
+			return err
+		}
+	}
+	if cfg.MaxPanicFileSizeBytes != defaults.MaxPanicFileSizeBytes {
+		if err := key.SetQWordValue("MaxPanicFileSizeBytes", uint64(cfg.MaxPanicFileSizeBytes)); err != nil {
+			return err
+		}
+	}
+	if cfg.MaxPanicBackups != defaults.MaxPanicBackups {
+		if err := key.SetDWordValue("MaxPanicBackups", uint32(cfg.MaxPanicBackups)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadPersistedInstallConfig reads back whatever persistInstallConfig wrote
+// for serviceName. Missing values are left at their zero value so the caller
+// can layer them onto a freshly constructed InstallConfig before calling
+// setDefaults. A missing Parameters key (the common case for a service that
+// was never customized) is not an error.
+func loadPersistedInstallConfig(serviceName string) (*InstallConfig, error) {
+	cfg := &InstallConfig{ServiceName: serviceName}
+
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE,
+		`SYSTEM\CurrentControlSet\Services\`+serviceName+`\Parameters`,
+		registry.QUERY_VALUE)
+	if err != nil {
+		if err == registry.ErrNotExist {
+			return cfg, nil
+		}
+		return nil, errors.Wrap(err, "opening service parameters registry key")
+	}
+	defer key.Close()
+
+	if v, _, err := key.GetStringValue("DisplayName"); err == nil {
+		cfg.DisplayName = v
+	}
+	if v, _, err := key.GetStringValue("Description"); err == nil {
+		cfg.Description = v
+	}
+	if v, _, err := key.GetStringsValue("Args"); err == nil {
+		cfg.Args = v
+	}
+	if v, _, err := key.GetIntegerValue("FailureRestartDelayMs"); err == nil {
+		cfg.FailureRestartDelay = time.Duration(v) * time.Millisecond
+	}
+	if v, _, err := key.GetIntegerValue("FailureResetPeriodSec"); err == nil {
+		cfg.FailureResetPeriod = time.Duration(v) * time.Second
+	}
+	if v, _, err := key.GetStringValue("LogFile"); err == nil {
+		cfg.LogFile = v
+	}
+	if v, _, err := key.GetStringValue("PanicFile"); err == nil {
+		cfg.RancherPanicFile = v
+	}
+	if v, _, err := key.GetStringValue("HomeDir"); err == nil {
+		cfg.HomeDir = v
+	}
+	if v, _, err := key.GetStringValue("EventLogFormat"); err == nil {
+		cfg.EventLogFormat = v
+	}
+	if v, _, err := key.GetIntegerValue("MaxLogSizeBytes"); err == nil {
+		cfg.MaxLogSizeBytes = int64(v)
+	}
+	if v, _, err := key.GetIntegerValue("MaxLogAgeSec"); err == nil {
+		cfg.MaxLogAge = time.Duration(v) * time.Second
+	}
+	if v, _, err := key.GetIntegerValue("MaxLogBackups"); err == nil {
+		cfg.MaxLogBackups = int(v)
+	}
+	if v, _, err := key.GetIntegerValue("MaxPanicFileSizeBytes"); err == nil {
+		cfg.MaxPanicFileSizeBytes = int64(v)
+	}
+	if v, _, err := key.GetIntegerValue("MaxPanicBackups"); err == nil {
+		cfg.MaxPanicBackups = int(v)
+	}
+
+	return cfg, nil
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func getServicePath() (string, error) {
@@ -149,7 +557,147 @@ func getServicePath() (string, error) {
 	return filepath.Abs(p)
 }
 
-func registerService() error {
+// serviceDependencyNode is a single node in the SCM dependency graph dumped
+// by logServiceDependencyGraph. It mirrors the fields a human would check by
+// hand with `sc qc` / `sc queryex` on each service in the chain.
+type serviceDependencyNode struct {
+	Name           string                   `json:"name"`
+	DisplayName    string                   `json:"display_name"`
+	State          string                   `json:"state"`
+	StartType      string                   `json:"start_type"`
+	PID            uint32                   `json:"pid"`
+	ErrorControl   string                   `json:"error_control"`
+	BinaryPathName string                   `json:"binary_path_name"`
+	Dependencies   []*serviceDependencyNode `json:"dependencies,omitempty"`
+	Error          string                   `json:"error,omitempty"`
+}
+
+// logServiceDependencyGraph walks the SCM dependency tree rooted at
+// rootService and dumps it as structured JSON into the rancher-per-host-subnet
+// log. It's meant to be called from startup failure paths so a bug report
+// captures the state of hns/vmcompute (and whatever they in turn depend on)
+// without asking the user to run PowerShell by hand.
+func logServiceDependencyGraph(rootService string) {
+	m, err := mgr.Connect()
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to connect to SCM while building service dependency graph")
+		return
+	}
+	defer m.Disconnect()
+
+	node := buildServiceDependencyNode(m, rootService, map[string]bool{}, 0)
+
+	graph, err := json.Marshal(node)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to marshal service dependency graph")
+		return
+	}
+
+	logrus.WithField("svc_graph", string(graph)).Error("Service dependency graph at startup failure")
+}
+
+// buildServiceDependencyNode inspects a single service and recurses into the
+// services it depends on (QueryServiceConfig's lpDependencies). visited
+// guards against cycles and depth caps runaway graphs on pathological
+// machines.
+func buildServiceDependencyNode(m *mgr.Mgr, name string, visited map[string]bool, depth int) *serviceDependencyNode {
+	key := strings.ToLower(name)
+	node := &serviceDependencyNode{Name: name}
+
+	if visited[key] {
+		node.Error = "already visited, not re-expanded"
+		return node
+	}
+	if depth >= maxServiceDependencyDepth {
+		node.Error = fmt.Sprintf("max depth %d reached, not expanded", maxServiceDependencyDepth)
+		return node
+	}
+	visited[key] = true
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	defer s.Close()
+
+	if cfg, err := s.Config(); err != nil {
+		node.Error = err.Error()
+	} else {
+		node.DisplayName = cfg.DisplayName
+		node.StartType = serviceStartTypeString(cfg.StartType)
+		node.ErrorControl = serviceErrorControlString(cfg.ErrorControl)
+		node.BinaryPathName = cfg.BinaryPathName
+		for _, dep := range cfg.Dependencies {
+			if dep == "" {
+				continue
+			}
+			node.Dependencies = append(node.Dependencies, buildServiceDependencyNode(m, dep, visited, depth+1))
+		}
+	}
+
+	if status, err := s.Query(); err != nil {
+		if node.Error == "" {
+			node.Error = err.Error()
+		}
+	} else {
+		node.State = serviceStateString(status.State)
+		node.PID = status.ProcessId
+	}
+
+	return node
+}
+
+func serviceStateString(state svc.State) string {
+	switch state {
+	case svc.Stopped:
+		return "stopped"
+	case svc.StartPending:
+		return "start_pending"
+	case svc.StopPending:
+		return "stop_pending"
+	case svc.Running:
+		return "running"
+	case svc.ContinuePending:
+		return "continue_pending"
+	case svc.PausePending:
+		return "pause_pending"
+	case svc.Paused:
+		return "paused"
+	default:
+		return fmt.Sprintf("unknown(%d)", state)
+	}
+}
+
+func serviceStartTypeString(startType uint32) string {
+	switch startType {
+	case mgr.StartManual:
+		return "manual"
+	case mgr.StartAutomatic:
+		return "automatic"
+	case mgr.StartDisabled:
+		return "disabled"
+	default:
+		return fmt.Sprintf("unknown(%d)", startType)
+	}
+}
+
+func serviceErrorControlString(errorControl uint32) string {
+	switch errorControl {
+	case mgr.ErrorIgnore:
+		return "ignore"
+	case mgr.ErrorNormal:
+		return "normal"
+	case mgr.ErrorSevere:
+		return "severe"
+	case mgr.ErrorCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("unknown(%d)", errorControl)
+	}
+}
+
+func registerService(cfg *InstallConfig) error {
 	p, err := getServicePath()
 	if err != nil {
 		return err
@@ -164,14 +712,14 @@ func registerService() error {
 		ServiceType:  windows.SERVICE_WIN32_OWN_PROCESS,
 		StartType:    mgr.StartAutomatic,
 		ErrorControl: mgr.ErrorNormal,
-		DisplayName:  "Rancher Per-host-subnet",
+		DisplayName:  cfg.DisplayName,
+		Description:  cfg.Description,
 	}
 
-	// Configure the service to launch with the arguments that were just passed.
-	args := []string{"--enable-route-update"}
-
-	s, err := m.CreateService(ServiceName, p, c, args...)
+	s, err := m.CreateService(cfg.ServiceName, p, c, cfg.Args...)
 	if err != nil {
+		logServiceDependencyGraph(hnsServiceName)
+		logServiceDependencyGraph(vmComputeServiceName)
 		return err
 	}
 	defer s.Close()
@@ -199,38 +747,38 @@ func registerService() error {
 		Delay uint32
 	}
 	t := []scAction{
-		{Type: scActionRestart, Delay: uint32(60 * time.Second / time.Millisecond)},
-		{Type: scActionRestart, Delay: uint32(60 * time.Second / time.Millisecond)},
+		{Type: scActionRestart, Delay: uint32(cfg.FailureRestartDelay / time.Millisecond)},
+		{Type: scActionRestart, Delay: uint32(cfg.FailureRestartDelay / time.Millisecond)},
 		{Type: scActionNone},
 	}
-	lpInfo := serviceFailureActions{ResetPeriod: uint32(24 * time.Hour / time.Second), ActionsCount: uint32(3), Actions: uintptr(unsafe.Pointer(&t[0]))}
+	lpInfo := serviceFailureActions{ResetPeriod: uint32(cfg.FailureResetPeriod / time.Second), ActionsCount: uint32(3), Actions: uintptr(unsafe.Pointer(&t[0]))}
 	err = windows.ChangeServiceConfig2(s.Handle, serviceConfigFailureActions, (*byte)(unsafe.Pointer(&lpInfo)))
 	if err != nil {
 		return err
 	}
 
-	err = eventlog.Install(ServiceName, p, false, eventlog.Info|eventlog.Warning|eventlog.Error)
+	err = eventlog.Install(cfg.ServiceName, p, false, eventlog.Info|eventlog.Warning|eventlog.Error)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return persistInstallConfig(cfg)
 }
 
-func unregisterService() error {
+func unregisterService(serviceName string) error {
 	m, err := mgr.Connect()
 	if err != nil {
 		return err
 	}
 	defer m.Disconnect()
 
-	s, err := m.OpenService(ServiceName)
+	s, err := m.OpenService(serviceName)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	eventlog.Remove(ServiceName)
+	eventlog.Remove(serviceName)
 	err = s.Delete()
 	if err != nil {
 		return err
@@ -238,27 +786,43 @@ func unregisterService() error {
 	return nil
 }
 
-func initService(register, unregister bool) error {
-	if _, err := os.Stat(homeDir); err != nil {
-		err = os.MkdirAll(homeDir, 0755)
+func initService(register, unregister bool, cfg *InstallConfig) error {
+	if cfg == nil {
+		cfg = &InstallConfig{}
+	}
+	cfg.setDefaults()
+
+	if _, err := os.Stat(cfg.HomeDir); err != nil {
+		err = os.MkdirAll(cfg.HomeDir, 0755)
 		if err != nil {
 			return err
 		}
 	}
 	if register {
-		err := registerService()
+		err := registerService(cfg)
 		if err != nil {
+			// registerService logs the dependency graph itself when
+			// CreateService fails; its other failures are reported
+			// here without it.
 			logrus.Fatalf("Failed to register service, err: %v", err)
 		}
 		os.Exit(0)
 	}
 	if unregister {
-		err := unregisterService()
+		err := unregisterService(cfg.ServiceName)
 		if err != nil {
 			logrus.Fatalf("Failed to unregister service, err: %v", err)
 		}
 		os.Exit(0)
 	}
+
+	// Running as the installed service: layer in whatever was persisted at
+	// install time, since the SCM restarts us with the original command
+	// line and won't know about custom settings.
+	if persisted, err := loadPersistedInstallConfig(cfg.ServiceName); err == nil {
+		mergeInstallConfig(cfg, persisted)
+	}
+
 	interactive, err := svc.IsAnInteractiveSession()
 	if err != nil {
 		return err
@@ -267,35 +831,30 @@ func initService(register, unregister bool) error {
 	h := &handler{
 		tosvc:   make(chan bool),
 		fromsvc: make(chan error),
+		cfg:     cfg,
 	}
 
 	var log *eventlog.Log
 	if !interactive {
-		log, err = eventlog.Open(ServiceName)
+		log, err = eventlog.Open(cfg.ServiceName)
 		if err != nil {
 			return err
 		}
 	}
 
-	logrus.AddHook(&etwHook{log})
-	if _, err := os.Stat(logFile); err != nil {
-		_, err := os.Create(logFile)
-		if err != nil {
-			return err
-		}
-	}
-	file, err := os.OpenFile(logFile, os.O_WRONLY, 0755)
+	logrus.AddHook(&etwHook{log: log, format: cfg.EventLogFormat})
+	logWriter, err := newRotatingLogWriter(cfg.LogFile, cfg.MaxLogSizeBytes, cfg.MaxLogAge, cfg.MaxLogBackups)
 	if err != nil {
 		return err
 	}
-	logrus.SetOutput(file)
+	logrus.SetOutput(logWriter)
 
 	service = h
 	go func() {
 		if interactive {
-			err = debug.Run(ServiceName, h)
+			err = debug.Run(cfg.ServiceName, h)
 		} else {
-			err = svc.Run(ServiceName, h)
+			err = svc.Run(cfg.ServiceName, h)
 		}
 
 		h.fromsvc <- err
@@ -309,8 +868,56 @@ func initService(register, unregister bool) error {
 	return nil
 }
 
-func (h *handler) started() error {
-	err := initPanicFile(rancherPanicFile)
+// mergeInstallConfig layers any fields persisted to the registry onto cfg.
+// Every non-zero persisted value replaces the one on cfg, whether that came
+// from the caller or from setDefaults.
+func mergeInstallConfig(cfg, persisted *InstallConfig) {
+	if persisted.DisplayName != "" {
+		cfg.DisplayName = persisted.DisplayName
+	}
+	if persisted.Description != "" {
+		cfg.Description = persisted.Description
+	}
+	if len(persisted.Args) > 0 {
+		cfg.Args = persisted.Args
+	}
+	if persisted.FailureRestartDelay != 0 {
+		cfg.FailureRestartDelay = persisted.FailureRestartDelay
+	}
+	if persisted.FailureResetPeriod != 0 {
+		cfg.FailureResetPeriod = persisted.FailureResetPeriod
+	}
+	if persisted.LogFile != "" {
+		cfg.LogFile = persisted.LogFile
+	}
+	if persisted.RancherPanicFile != "" {
+		cfg.RancherPanicFile = persisted.RancherPanicFile
+	}
+	if persisted.HomeDir != "" {
+		cfg.HomeDir = persisted.HomeDir
+	}
+	if persisted.EventLogFormat != "" {
+		cfg.EventLogFormat = persisted.EventLogFormat
+	}
+	if persisted.MaxLogSizeBytes != 0 {
+		cfg.MaxLogSizeBytes = persisted.MaxLogSizeBytes
+	}
+	if persisted.MaxLogAge != 0 {
+		cfg.MaxLogAge = persisted.MaxLogAge
+	}
+	if persisted.MaxLogBackups != 0 {
+		cfg.MaxLogBackups = persisted.MaxLogBackups
+	}
+	if persisted.MaxPanicFileSizeBytes != 0 {
+		cfg.MaxPanicFileSizeBytes = persisted.MaxPanicFileSizeBytes
+	}
+	if persisted.MaxPanicBackups != 0 {
+		cfg.MaxPanicBackups = persisted.MaxPanicBackups
+	}
+}
+
+func (h *handler) started(ctx context.Context) error {
+	err := initPanicFile(h.cfg.RancherPanicFile, h.cfg.MaxPanicFileSizeBytes, h.cfg.MaxPanicBackups)
 	if err != nil {
 		return err
 	}
@@ -319,8 +926,8 @@ func (h *handler) started() error {
 	return nil
 }
 
-func (h *handler) stopped(err error) {
-	logrus.Debugf("Stopping service: %v", err)
+func (h *handler) stopped(ctx context.Context, err error) {
+	logrus.WithContext(ctx).Debugf("Stopping service: %v", err)
 	h.tosvc <- err != nil
 	<-h.fromsvc
 }
@@ -334,10 +941,16 @@ func (h *handler) Execute(_ []string, r <-chan svc.ChangeRequest, s chan<- svc.S
 	failed := <-h.tosvc
 	if failed {
 		logrus.Debug("Aborting service start due to failure during initialization")
+		logServiceDependencyGraph(hnsServiceName)
+		logServiceDependencyGraph(vmComputeServiceName)
 		return true, 1
 	}
 
-	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.Accepted(windows.SERVICE_ACCEPT_PARAMCHANGE)}
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown |
+		svc.Accepted(windows.SERVICE_ACCEPT_PARAMCHANGE) |
+		svc.Accepted(windows.SERVICE_ACCEPT_SESSIONCHANGE) |
+		svc.Accepted(windows.SERVICE_ACCEPT_POWEREVENT) |
+		svc.Accepted(windows.SERVICE_ACCEPT_NETBINDCHANGE)}
 	logrus.Debug("Service running")
 Loop:
 	for {
@@ -347,6 +960,20 @@ Loop:
 		case c := <-r:
 			switch c.Cmd {
 			case svc.Cmd(windows.SERVICE_CONTROL_PARAMCHANGE):
+			case svc.Cmd(windows.SERVICE_CONTROL_SESSIONCHANGE):
+				if h.OnSessionChange != nil {
+					h.OnSessionChange(c.EventType, sessionIDFromEventData(c.EventData))
+				}
+			case svc.Cmd(windows.SERVICE_CONTROL_POWEREVENT):
+				if c.EventType == pbtAPMResumeSuspend || c.EventType == pbtAPMResumeAutomatic {
+					if h.OnResumeFromSuspend != nil {
+						h.OnResumeFromSuspend()
+					}
+				}
+			case svc.Cmd(windows.SERVICE_CONTROL_NETBINDADD):
+				if h.OnNetBindAdd != nil {
+					h.OnNetBindAdd()
+				}
 			case svc.Interrogate:
 				s <- c.CurrentStatus
 			case svc.Stop, svc.Shutdown:
@@ -364,12 +991,140 @@ Loop:
 	return false, 0
 }
 
-func initPanicFile(path string) error {
-	var err error
-	_, err = os.Create(rancherPanicFile)
+// rotatingLogWriter is an io.Writer over logFile that rotates the
+// underlying file once it exceeds maxSize or maxAge, gzip-compressing the
+// rotated-out generation and keeping up to maxBackups of them.
+type rotatingLogWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func newRotatingLogWriter(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingLogWriter, error) {
+	w := &rotatingLogWriter{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingLogWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0755)
 	if err != nil {
 		return err
 	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = st.Size()
+	w.openedAt = st.ModTime()
+	return nil
+}
+
+func (w *rotatingLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.shouldRotate() {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingLogWriter) shouldRotate() bool {
+	if w.maxSize > 0 && w.size >= w.maxSize {
+		return true
+	}
+	if w.maxAge > 0 && time.Since(w.openedAt) >= w.maxAge {
+		return true
+	}
+	return false
+}
+
+func (w *rotatingLogWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := rotateGenerations(w.path, w.maxBackups); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// rotateGenerations moves path out of the way to path.1.gz, shifting any
+// existing path.N.gz generations up by one and dropping whatever falls off
+// the end of maxBackups. It's shared by the log file and panic file
+// rotation policies.
+func rotateGenerations(path string, maxBackups int) error {
+	if maxBackups <= 0 {
+		maxBackups = 1
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d.gz", path, maxBackups))
+	for i := maxBackups - 1; i >= 1; i-- {
+		src := fmt.Sprintf("%s.%d.gz", path, i)
+		dst := fmt.Sprintf("%s.%d.gz", path, i+1)
+		if _, err := os.Stat(src); err == nil {
+			os.Rename(src, dst)
+		}
+	}
+
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return gzipAndRemove(rotated, rotated+".gz")
+}
+
+func gzipAndRemove(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, in); err != nil {
+		gw.Close()
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+func initPanicFile(path string, maxSize int64, maxBackups int) error {
+	panicFileMu.Lock()
+	defer panicFileMu.Unlock()
+
+	var err error
 	panicFile, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0)
 	if err != nil {
 		return err
@@ -407,10 +1162,88 @@ func initPanicFile(path string) error {
 		return err
 	}
 
+	panicMonitorStop = make(chan struct{})
+	panicMonitorDone = make(chan struct{})
+	go monitorPanicFileSize(path, maxSize, maxBackups, panicMonitorStop, panicMonitorDone)
+
+	return nil
+}
+
+// monitorPanicFileSize periodically checks panicFile's size and rotates it
+// once it exceeds maxSize, keeping a ring of panic.log.1..N gzip-compressed
+// generations. It runs for the lifetime of the service, exits when stop is
+// closed, and closes done right before returning so removePanicFile can wait
+// out any rotation already in flight.
+func monitorPanicFileSize(path string, maxSize int64, maxBackups int, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	if maxSize <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			panicFileMu.Lock()
+			st, err := panicFile.Stat()
+			panicFileMu.Unlock()
+			if err != nil || st.Size() < maxSize {
+				continue
+			}
+			if err := rotatePanicFile(path, maxBackups); err != nil {
+				logrus.WithError(err).Warn("Failed to rotate panic file")
+			}
+		}
+	}
+}
+
+// rotatePanicFile shifts the current panic file into the generation ring and
+// points STD_ERROR_HANDLE at a fresh one, preserving the oldStderr restore
+// semantics used by removePanicFile.
+func rotatePanicFile(path string, maxBackups int) error {
+	panicFileMu.Lock()
+	defer panicFileMu.Unlock()
+
+	previous := panicFile
+
+	if err := rotateGenerations(path, maxBackups); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	sh := syscall.STD_ERROR_HANDLE
+	r, _, err := setStdHandle.Call(uintptr(sh), uintptr(f.Fd()))
+	if r == 0 && err != nil {
+		f.Close()
+		return err
+	}
+
+	panicFile = f
+	previous.Close()
 	return nil
 }
 
 func removePanicFile() {
+	if panicMonitorStop != nil {
+		close(panicMonitorStop)
+		panicMonitorStop = nil
+		// Wait for a rotation that may already be in flight so we don't
+		// close/remove panicFile out from under rotatePanicFile.
+		<-panicMonitorDone
+	}
+
+	panicFileMu.Lock()
+	defer panicFileMu.Unlock()
+
 	if st, err := panicFile.Stat(); err == nil {
 		if st.Size() == 0 {
 			sh := syscall.STD_ERROR_HANDLE
@@ -421,39 +1254,78 @@ func removePanicFile() {
 	}
 }
 
-func notifySystem() {
+// SetSessionChangeHandler registers fn to be called for each
+// SERVICE_CONTROL_SESSIONCHANGE event delivered to Execute, so callers like
+// the route-update subsystem can re-probe HNS networks on logon/logoff.
+// eventType is the raw WTS session change code (e.g. WTSSessionLogon or
+// WTSSessionLogoff); every session change event is passed through, not only
+// logon/logoff. Call after Init.
+func SetSessionChangeHandler(fn func(eventType uint32, sessionID uint32)) {
 	if service != nil {
-		err := service.started()
+		service.OnSessionChange = fn
+	}
+}
+
+// SetResumeFromSuspendHandler registers fn to be called when Execute sees a
+// SERVICE_CONTROL_POWEREVENT indicating the host resumed from suspend. Call
+// after Init.
+func SetResumeFromSuspendHandler(fn func()) {
+	if service != nil {
+		service.OnResumeFromSuspend = fn
+	}
+}
+
+// SetNetBindAddHandler registers fn to be called when Execute sees a
+// SERVICE_CONTROL_NETBINDADD event, e.g. so routes can be reprogrammed after
+// a NIC is rebound. Call after Init.
+func SetNetBindAddHandler(fn func()) {
+	if service != nil {
+		service.OnNetBindAdd = fn
+	}
+}
+
+func notifySystem(ctx context.Context) {
+	if service != nil {
+		err := service.started(ctx)
 		if err != nil {
-			logrus.Fatal(err)
+			logrus.WithContext(ctx).Fatal(err)
 		}
 	}
 }
 
-func NotifyShutdown(err error) {
+// NotifyShutdown reports a fatal shutdown error, or a clean stop when err is
+// nil. Pass the context returned by Init so the shutdown log entries carry
+// the same correlation ID as the rest of this process's lifecycle.
+func NotifyShutdown(ctx context.Context, err error) {
 	if service != nil {
 		if err != nil {
-			logrus.Fatal(err)
+			logrus.WithContext(ctx).Fatal(err)
 		}
-		service.stopped(err)
+		service.stopped(ctx, err)
 	}
 }
 
-func Init(register, unregister bool) error {
-	if err := initService(register, unregister); err != nil {
-		return err
+// Init starts the service (or performs register/unregister and exits) and
+// returns a context carrying an auto-generated correlation ID. Callers
+// should pass that context to NotifyShutdown so its log entries carry the
+// same ID. Only entries logged through logrus.WithContext with that context
+// get the ID, and only in the event log entry etwHook.Fire writes.
+func Init(register, unregister bool, cfg *InstallConfig) (context.Context, error) {
+	if err := initService(register, unregister, cfg); err != nil {
+		return nil, err
 	}
 
-	notifySystem()
+	ctx := newCorrelationContext()
+	notifySystem(ctx)
 
 	//listen to service stop signal
 	go func() {
 		signal := <-serviceSignal
 		if signal {
-			logrus.Info("Receiving service stop signal. Stopping per-host-subnet")
+			logrus.WithContext(ctx).Info("Receiving service stop signal. Stopping per-host-subnet")
 			os.Exit(0)
 		}
 	}()
 
-	return nil
+	return ctx, nil
 }